@@ -0,0 +1,126 @@
+// Copyright 2013 Fredrik Ehnbom
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package text
+
+// ChangeEvent describes what a single RegionSet mutation changed,
+// so that listeners like undo stacks, mark decorations or LSP
+// selection sync can update incrementally instead of diffing
+// Regions() themselves.
+type ChangeEvent struct {
+	// Added are the regions present after the mutation that weren't
+	// present, in that exact form, before it. A region that merely
+	// moved (Adjust) without merging with another region is not
+	// included.
+	Added []Region
+
+	// Removed are the regions that were present before the mutation
+	// and are gone afterwards in that exact form: subtracted away
+	// entirely, trimmed by a Subtract (the remaining pieces are then in
+	// Added), or folded into an Added region; see Merged for the latter
+	// case. For Adjust, regions folded together by the re-merge are
+	// reported at their already-adjusted positions.
+	Removed []Region
+
+	// Merged records, for each Added region that came from coalescing
+	// previously distinct regions, the regions that were coalesced
+	// into it. Every region in every entry also appears in Removed.
+	Merged [][]Region
+}
+
+// AddOnChangeEvent adds a callback identified with the given key that
+// receives a ChangeEvent describing what changed on every mutation.
+// If a callback is already defined for that name, it is overwritten.
+func (r *RegionSet) AddOnChangeEvent(key string, cb func(ChangeEvent)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.onChangeEventCallbacks == nil {
+		r.onChangeEventCallbacks = make(map[string]func(ChangeEvent))
+	}
+	r.onChangeEventCallbacks[key] = cb
+}
+
+// ClearOnChangeEvent removes the callback associated with the given key.
+func (r *RegionSet) ClearOnChangeEvent(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.onChangeEventCallbacks, key)
+}
+
+// diffRegions computes the ChangeEvent between before and after, two
+// sorted-by-Begin() snapshots of a RegionSet's regions taken around a
+// batch of mutations. It's used instead of summing the ChangeEvent of
+// each individual mutation in the batch, since a region reported Added
+// by one step can be superseded by a later step in the same batch, and
+// only the final outcome should be observable.
+//
+// This only works for a batch that exclusively merges regions
+// together, never deletes one outright, which is why AddAll uses it
+// but Transaction.Commit doesn't: a before/after diff can't tell "this
+// region was folded into that Added region by a merge" apart from
+// "this region was deleted by an unrelated Subtract/Clear and happens
+// to fall inside some other Added region's span". Transaction.Commit
+// tracks real per-op provenance instead.
+func diffRegions(before, after []Region) ChangeEvent {
+	var ev ChangeEvent
+
+	afterSet := make(map[Region]bool, len(after))
+	for _, a := range after {
+		afterSet[a] = true
+	}
+	for _, b := range before {
+		if !afterSet[b] {
+			ev.Removed = append(ev.Removed, b)
+		}
+	}
+
+	beforeSet := make(map[Region]bool, len(before))
+	for _, b := range before {
+		beforeSet[b] = true
+	}
+	for _, a := range after {
+		if !beforeSet[a] {
+			ev.Added = append(ev.Added, a)
+		}
+	}
+
+	// Group each Removed region under whichever Added region's span
+	// fully contains it, if any. Both lists are still in Begin() order,
+	// so a single left-to-right pass suffices. A Removed region with no
+	// containing Added region was simply deleted (Subtract, Clear), not
+	// coalesced into something else.
+	ri := 0
+	for _, a := range ev.Added {
+		var from []Region
+		for ri < len(ev.Removed) && (ev.Removed[ri].Begin() < a.End() ||
+			ev.Removed[ri].Empty() && ev.Removed[ri].Begin() == a.End()) {
+			if a.Begin() <= ev.Removed[ri].Begin() && ev.Removed[ri].End() <= a.End() {
+				from = append(from, ev.Removed[ri])
+			}
+			ri++
+		}
+		if len(from) > 0 {
+			ev.Merged = append(ev.Merged, from)
+		}
+	}
+	return ev
+}
+
+// notify fires both the plain onChange callbacks and the
+// AddOnChangeEvent callbacks for ev. It must be called without r.lock
+// held.
+func (r *RegionSet) notify(ev ChangeEvent) {
+	r.onChange()
+
+	r.lock.RLock()
+	cbs := make([]func(ChangeEvent), 0, len(r.onChangeEventCallbacks))
+	for _, cb := range r.onChangeEventCallbacks {
+		cbs = append(cbs, cb)
+	}
+	r.lock.RUnlock()
+
+	for _, cb := range cbs {
+		cb(ev)
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2013 Fredrik Ehnbom
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package text
+
+import "sort"
+
+// rtNode is a single node of a regionTree. Each node is augmented with
+// max, the largest End() found anywhere in its subtree, so that
+// overlap queries can skip subtrees that provably contain no match.
+type rtNode struct {
+	region      Region
+	max         int
+	left, right *rtNode
+}
+
+// regionTree is a binary search tree keyed on Region.Begin() and
+// augmented with subtree-max End(), used as the backing store for a
+// RegionSet. It allows overlap queries to run in O(log n + k), where
+// k is the number of regions returned, instead of scanning every
+// region in the set.
+//
+// Insert/Remove themselves are plain unbalanced BST operations, so a
+// run of single-region calls in sorted order (as repeated Add or
+// Subtract calls make, e.g. adding a cursor at the end of every line)
+// would skew the tree over time the same way an unbalanced BST always
+// can. To bound that, Insert and Remove force a full, balanced rebuild
+// (the same one buildRegionTree does for a bulk change like Adjust)
+// every maxUnbalancedOps calls, so the tree never accumulates more
+// than a small, constant amount of imbalance between rebuilds,
+// regardless of how long a session runs between bulk operations.
+type regionTree struct {
+	root *rtNode
+	size int
+
+	// unbalancedOps counts single-region Insert/Remove calls since the
+	// tree was last known balanced (built fresh or last
+	// self-rebalanced). Reset to 0 whenever that happens.
+	unbalancedOps int
+}
+
+// maxUnbalancedOps bounds how many single-region Insert/Remove calls a
+// regionTree tolerates before its next mutation forces a rebalance.
+// Kept small and independent of the tree's size: an O(maxUnbalancedOps)
+// chain on top of an otherwise balanced tree is cheap to walk no
+// matter how large the tree is, so queries stay O(log n + k) during a
+// long burst of sequential Adds or Subtracts. Each rebalance is itself
+// a full O(n log n) rebuild of the tree, paid once every
+// maxUnbalancedOps single-region calls.
+const maxUnbalancedOps = 32
+
+// rebalance rebuilds t from its own current contents, balanced, and
+// resets unbalancedOps.
+func (t *regionTree) rebalance() {
+	rs := make([]Region, 0, t.size)
+	t.Ascend(func(r Region) bool {
+		rs = append(rs, r)
+		return true
+	})
+	*t = buildRegionTree(rs)
+}
+
+func newRtNode(r Region) *rtNode {
+	return &rtNode{region: r, max: r.End()}
+}
+
+// updateMax recomputes n.max from n's own End() and its children.
+func (n *rtNode) updateMax() {
+	n.max = n.region.End()
+	if n.left != nil && n.left.max > n.max {
+		n.max = n.left.max
+	}
+	if n.right != nil && n.right.max > n.max {
+		n.max = n.right.max
+	}
+}
+
+func (n *rtNode) insert(r Region) *rtNode {
+	if n == nil {
+		return newRtNode(r)
+	}
+	if r.Begin() < n.region.Begin() {
+		n.left = n.left.insert(r)
+	} else {
+		n.right = n.right.insert(r)
+	}
+	n.updateMax()
+	return n
+}
+
+// Insert adds r to the tree.
+func (t *regionTree) Insert(r Region) {
+	t.root = t.root.insert(r)
+	t.size++
+	t.unbalancedOps++
+	if t.unbalancedOps >= maxUnbalancedOps {
+		t.rebalance()
+	}
+}
+
+// min returns the node with the smallest Begin() in the subtree.
+func (n *rtNode) min() *rtNode {
+	for n.left != nil {
+		n = n.left
+	}
+	return n
+}
+
+// remove deletes the first node equal to r from the subtree rooted at
+// n, returning the new subtree root and whether a node was removed.
+func (n *rtNode) remove(r Region) (*rtNode, bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	var ok bool
+	switch {
+	case r.Begin() < n.region.Begin():
+		n.left, ok = n.left.remove(r)
+	case r.Begin() > n.region.Begin():
+		n.right, ok = n.right.remove(r)
+	case n.region != r:
+		// Same Begin(), but not the node we're after: ties on Begin()
+		// are broken arbitrarily on insert, so it could be on either
+		// side.
+		if n.left, ok = n.left.remove(r); !ok {
+			n.right, ok = n.right.remove(r)
+		}
+	default:
+		ok = true
+		switch {
+		case n.left == nil:
+			return n.right, true
+		case n.right == nil:
+			return n.left, true
+		default:
+			succ := n.right.min()
+			n.region = succ.region
+			n.right, _ = n.right.remove(succ.region)
+		}
+	}
+	if ok {
+		n.updateMax()
+	}
+	return n, ok
+}
+
+// Remove deletes r from the tree, reporting whether it was present.
+func (t *regionTree) Remove(r Region) bool {
+	root, ok := t.root.remove(r)
+	t.root = root
+	if ok {
+		t.size--
+		t.unbalancedOps++
+		if t.unbalancedOps >= maxUnbalancedOps {
+			t.rebalance()
+		}
+	}
+	return ok
+}
+
+// Len returns the number of regions held in the tree.
+func (t *regionTree) Len() int {
+	return t.size
+}
+
+// ascend calls fn for every region in the subtree, in ascending
+// Begin() order, stopping as soon as fn returns false.
+func (n *rtNode) ascend(fn func(Region) bool) bool {
+	if n == nil {
+		return true
+	}
+	if !n.left.ascend(fn) {
+		return false
+	}
+	if !fn(n.region) {
+		return false
+	}
+	return n.right.ascend(fn)
+}
+
+// Ascend calls fn for every region in the tree, in ascending Begin()
+// order, stopping early if fn returns false.
+func (t *regionTree) Ascend(fn func(Region) bool) {
+	t.root.ascend(fn)
+}
+
+// overlapsRegion reports whether a and b should be considered
+// overlapping for the purposes of RegionSet: they are the very same
+// region, they intersect, or one covers the other.
+func overlapsRegion(a, b Region) bool {
+	return a == b || a.Intersects(b) || a.Covers(b) || b.Covers(a)
+}
+
+// overlapping appends, in ascending Begin() order, every region in
+// the subtree rooted at n that overlaps ref.
+func (n *rtNode) overlapping(ref Region, dst []Region) []Region {
+	if n == nil {
+		return dst
+	}
+	if n.left != nil && n.left.max >= ref.Begin() {
+		dst = n.left.overlapping(ref, dst)
+	}
+	if overlapsRegion(n.region, ref) {
+		dst = append(dst, n.region)
+	}
+	if n.region.Begin() <= ref.End() {
+		dst = n.right.overlapping(ref, dst)
+	}
+	return dst
+}
+
+// Overlapping returns every region in the tree that overlaps ref, in
+// ascending Begin() order.
+func (t *regionTree) Overlapping(ref Region) []Region {
+	return t.root.overlapping(ref, nil)
+}
+
+// predecessor returns the region with the largest Begin() <= p, if
+// any, found by descending the tree along the search path for p
+// rather than scanning every node.
+func (n *rtNode) predecessor(p int) (ret Region, found bool) {
+	for n != nil {
+		if n.region.Begin() <= p {
+			ret, found = n.region, true
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	return
+}
+
+// successor returns the region with the smallest Begin() > p, if any.
+func (n *rtNode) successor(p int) (ret Region, found bool) {
+	for n != nil {
+		if n.region.Begin() > p {
+			ret, found = n.region, true
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return
+}
+
+// Predecessor returns the region with the largest Begin() <= p.
+func (t *regionTree) Predecessor(p int) (Region, bool) {
+	return t.root.predecessor(p)
+}
+
+// Successor returns the region with the smallest Begin() > p.
+func (t *regionTree) Successor(p int) (Region, bool) {
+	return t.root.successor(p)
+}
+
+// buildRegionTree builds a balanced regionTree from rs. rs does not
+// need to be sorted or non-overlapping.
+//
+// Building it by repeated Insert would be wrong here even though rs
+// is usually already sorted by the caller: handing an already-sorted
+// slice to a plain BST insert one-by-one produces a pure right-leaning
+// chain, the worst case rather than the common case. Sorting
+// explicitly and then always splitting on the median instead
+// guarantees O(log n) depth no matter what order rs arrives in.
+func buildRegionTree(rs []Region) regionTree {
+	sorted := append([]Region(nil), rs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Begin() < sorted[j].Begin()
+	})
+	return regionTree{root: buildBalanced(sorted), size: len(sorted)}
+}
+
+// buildBalanced builds a balanced subtree from rs, which must already
+// be sorted by Begin(), by recursively making the median element the
+// root of each subtree.
+func buildBalanced(rs []Region) *rtNode {
+	if len(rs) == 0 {
+		return nil
+	}
+	mid := len(rs) / 2
+	n := newRtNode(rs[mid])
+	n.left = buildBalanced(rs[:mid])
+	n.right = buildBalanced(rs[mid+1:])
+	n.updateMax()
+	return n
+}
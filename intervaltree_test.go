@@ -0,0 +1,171 @@
+// Copyright 2013 Fredrik Ehnbom
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package text
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func regionsEqual(t *testing.T, got, want []Region) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRegionTreeInsertAscend(t *testing.T) {
+	var tree regionTree
+	rs := []Region{{5, 6}, {1, 2}, {9, 10}, {3, 4}}
+	for _, r := range rs {
+		tree.Insert(r)
+	}
+	if tree.Len() != len(rs) {
+		t.Fatalf("Len() = %d, want %d", tree.Len(), len(rs))
+	}
+
+	var got []Region
+	tree.Ascend(func(r Region) bool {
+		got = append(got, r)
+		return true
+	})
+	regionsEqual(t, got, []Region{{1, 2}, {3, 4}, {5, 6}, {9, 10}})
+}
+
+func TestRegionTreeRemove(t *testing.T) {
+	var tree regionTree
+	rs := []Region{{5, 6}, {1, 2}, {9, 10}, {3, 4}}
+	for _, r := range rs {
+		tree.Insert(r)
+	}
+
+	if !tree.Remove(Region{1, 2}) {
+		t.Fatal("Remove(1,2) = false, want true")
+	}
+	if tree.Remove(Region{100, 200}) {
+		t.Fatal("Remove of absent region = true, want false")
+	}
+	if tree.Len() != len(rs)-1 {
+		t.Fatalf("Len() = %d, want %d", tree.Len(), len(rs)-1)
+	}
+
+	var got []Region
+	tree.Ascend(func(r Region) bool {
+		got = append(got, r)
+		return true
+	})
+	regionsEqual(t, got, []Region{{3, 4}, {5, 6}, {9, 10}})
+}
+
+func TestRegionTreeOverlapping(t *testing.T) {
+	var tree regionTree
+	for _, r := range []Region{{0, 5}, {10, 15}, {20, 25}, {30, 35}} {
+		tree.Insert(r)
+	}
+
+	got := tree.Overlapping(Region{12, 22})
+	regionsEqual(t, got, []Region{{10, 15}, {20, 25}})
+
+	if got := tree.Overlapping(Region{100, 200}); got != nil {
+		t.Fatalf("Overlapping(100,200) = %v, want nil", got)
+	}
+}
+
+func TestRegionTreePredecessorSuccessor(t *testing.T) {
+	var tree regionTree
+	for _, r := range []Region{{0, 5}, {10, 15}, {20, 25}} {
+		tree.Insert(r)
+	}
+
+	if pred, ok := tree.Predecessor(12); !ok || pred != (Region{10, 15}) {
+		t.Fatalf("Predecessor(12) = %v, %v, want {10 15}, true", pred, ok)
+	}
+	if _, ok := tree.Predecessor(-1); ok {
+		t.Fatal("Predecessor(-1) = true, want false")
+	}
+	if succ, ok := tree.Successor(12); !ok || succ != (Region{20, 25}) {
+		t.Fatalf("Successor(12) = %v, %v, want {20 25}, true", succ, ok)
+	}
+	if _, ok := tree.Successor(100); ok {
+		t.Fatal("Successor(100) = true, want false")
+	}
+}
+
+// TestBuildRegionTreeBalanced guards against the degenerate case a
+// plain left-to-right Insert produces when fed an already-sorted
+// slice: a pure right-leaning chain of depth n instead of a tree of
+// depth O(log n).
+func TestBuildRegionTreeBalanced(t *testing.T) {
+	rs := make([]Region, 1000)
+	for i := range rs {
+		rs[i] = Region{i * 2, i*2 + 1}
+	}
+
+	tree := buildRegionTree(rs)
+	depth := tree.root.height()
+
+	// A balanced tree over 1000 nodes has depth around log2(1000) ~
+	// 10; a degenerate chain would have depth 1000. Leave generous
+	// headroom above the balanced case without coming anywhere near
+	// the degenerate one.
+	if want := 20; depth > want {
+		t.Fatalf("tree depth = %d, want <= %d (degenerate build?)", depth, want)
+	}
+}
+
+// TestRegionTreeSelfBalancesOnSequentialInsert guards against the
+// single-region Insert path (the one Add/Subtract/CheckAndAdd drive)
+// degenerating into a chain over a long run with no intervening bulk
+// rebuild, the same failure mode TestBuildRegionTreeBalanced covers
+// for the bulk-rebuild path.
+func TestRegionTreeSelfBalancesOnSequentialInsert(t *testing.T) {
+	var tree regionTree
+	for i := 0; i < 2000; i++ {
+		tree.Insert(Region{i * 2, i*2 + 1})
+	}
+
+	depth := tree.root.height()
+	if want := maxUnbalancedOps + 20; depth > want {
+		t.Fatalf("tree depth = %d, want <= %d (no self-rebalance on sequential insert?)", depth, want)
+	}
+}
+
+func (n *rtNode) height() int {
+	if n == nil {
+		return 0
+	}
+	l, r := n.left.height(), n.right.height()
+	if l > r {
+		return l + 1
+	}
+	return r + 1
+}
+
+func TestBuildRegionTreeUnordered(t *testing.T) {
+	rs := make([]Region, 200)
+	perm := rand.New(rand.NewSource(1)).Perm(len(rs))
+	for i, p := range perm {
+		rs[i] = Region{p * 2, p*2 + 1}
+	}
+
+	tree := buildRegionTree(rs)
+	if tree.Len() != len(rs) {
+		t.Fatalf("Len() = %d, want %d", tree.Len(), len(rs))
+	}
+
+	var got []Region
+	tree.Ascend(func(r Region) bool {
+		got = append(got, r)
+		return true
+	})
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Begin() < rs[j].Begin() })
+	regionsEqual(t, got, rs)
+}
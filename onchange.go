@@ -0,0 +1,176 @@
+// Copyright 2013 Fredrik Ehnbom
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package text
+
+import (
+	"sync"
+)
+
+// CallbackMode controls how a RegionSet dispatches a change
+// notification registered via AddOnChangeMode.
+type CallbackMode int
+
+const (
+	// Sync dispatches the callback on the goroutine that triggered the
+	// notification, once per triggering mutation. This is what
+	// AddOnChange uses, and is the only mode that existed before
+	// AddOnChangeMode.
+	Sync CallbackMode = iota
+
+	// Coalesced drops fires that arrive while a previous fire for the
+	// same key is still running, and instead guarantees one more fire
+	// once that run completes. This turns a burst of mutations (e.g.
+	// every region shifting during an Adjust) into at most one
+	// overlapping execution of the callback, at the cost of the
+	// callback sometimes observing a RegionSet that has already moved
+	// on from the state that triggered the fire it's handling.
+	Coalesced
+
+	// Async dispatches the callback on a worker goroutine owned by the
+	// RegionSet, so the mutating goroutine doesn't wait on it while
+	// fewer than 64 fires are queued for that key. Fires for a single
+	// key are delivered in the order they were raised, but may lag
+	// behind the mutation that raised them. Once a slow or blocked
+	// callback has 64 fires queued, the next fire blocks the mutating
+	// goroutine, and with it every callback fired after this one, until
+	// the worker takes one off the queue.
+	Async
+)
+
+// onChangeEntry holds the dispatch state for a single AddOnChangeMode
+// registration.
+type onChangeEntry struct {
+	cb   func()
+	mode CallbackMode
+
+	// asyncCh is this entry's own worker channel, drained by the
+	// goroutine startAsyncWorker starts for it; only used by Async
+	// entries. Each key gets its own channel and goroutine so that a
+	// slow or blocked callback for one key doesn't back up another
+	// key's fires until its own channel's buffer is full.
+	//
+	// asyncCh is never closed: onChange snapshots entries under only an
+	// RLock and fires them after releasing it, so a concurrent
+	// ClearOnChange/re-register can't be allowed to close a channel a
+	// fire might still be sending on without racing that send.
+	asyncCh chan func()
+
+	// mu guards running/pending, used by Coalesced entries only.
+	mu      sync.Mutex
+	running bool
+	pending bool
+}
+
+// fire dispatches the callback according to the entry's mode. It must
+// be called without r.lock held, so that the callback is free to call
+// back into the RegionSet.
+func (e *onChangeEntry) fire() {
+	switch e.mode {
+	case Coalesced:
+		e.fireCoalesced()
+	case Async:
+		e.asyncCh <- e.cb
+	default:
+		e.cb()
+	}
+}
+
+// fireCoalesced runs cb on the calling goroutine unless a previous
+// call is already running it, in which case it just marks a fire as
+// pending and returns. Whichever goroutine is running cb keeps
+// re-running it until no fire arrived while it was busy, guaranteeing
+// the last fire is always eventually observed.
+func (e *onChangeEntry) fireCoalesced() {
+	e.mu.Lock()
+	if e.running {
+		e.pending = true
+		e.mu.Unlock()
+		return
+	}
+	e.running = true
+	e.mu.Unlock()
+
+	for {
+		e.cb()
+
+		e.mu.Lock()
+		if !e.pending {
+			e.running = false
+			e.mu.Unlock()
+			return
+		}
+		e.pending = false
+		e.mu.Unlock()
+	}
+}
+
+// startAsyncWorker spins up the goroutine that this entry's Async
+// fires dispatch onto. Each Async entry gets its own channel, buffered
+// to 64 fires, and goroutine, so a slow or blocked callback for one key
+// only delays fires for that key until that buffer fills; after that,
+// firing it blocks the goroutine that is dispatching the notification.
+func (e *onChangeEntry) startAsyncWorker() {
+	ch := make(chan func(), 64)
+	e.asyncCh = ch
+	go func() {
+		for cb := range ch {
+			cb()
+		}
+	}()
+}
+
+// AddOnChange adds a callback func() identified with the given key,
+// dispatched synchronously (see CallbackMode Sync). If a callback is
+// already defined for that name, it is overwritten.
+func (r *RegionSet) AddOnChange(key string, cb func()) {
+	r.AddOnChangeMode(key, Sync, cb)
+}
+
+// AddOnChangeMode adds a callback func() identified with the given
+// key, dispatched according to mode. If a callback is already defined
+// for that name, it is overwritten.
+func (r *RegionSet) AddOnChangeMode(key string, mode CallbackMode, cb func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.onChangeCallbacks == nil {
+		r.onChangeCallbacks = make(map[string]*onChangeEntry)
+	}
+	entry := &onChangeEntry{cb: cb, mode: mode}
+	if mode == Async {
+		entry.startAsyncWorker()
+	}
+	r.onChangeCallbacks[key] = entry
+}
+
+// ClearOnChange removes the callback func() associated with the given
+// key.
+//
+// If it was an Async entry, its worker goroutine is not shut down: the
+// goroutine snapshot in onChange may still be about to send to its
+// channel, and closing a channel out from under a concurrent (or
+// in-flight) send panics. Left alone, the channel and its goroutine
+// are simply unreferenced by this RegionSet from now on and leak until
+// the process exits; that's a cheaper price than a racy close.
+func (r *RegionSet) ClearOnChange(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.onChangeCallbacks, key)
+}
+
+// onChange dispatches a change notification to every registered
+// callback, per its CallbackMode. It must be called without r.lock
+// held.
+func (r *RegionSet) onChange() {
+	r.lock.RLock()
+	entries := make([]*onChangeEntry, 0, len(r.onChangeCallbacks))
+	for _, e := range r.onChangeCallbacks {
+		entries = append(entries, e)
+	}
+	r.lock.RUnlock()
+
+	for _, e := range entries {
+		e.fire()
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2013 Fredrik Ehnbom
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package text
+
+// overlapCacheSize bounds how many certified spans a RegionSet
+// remembers. It's small on purpose: callers like syntax highlighting,
+// bracket matching and hover tooltips re-query the same neighbourhood
+// over and over, so a handful of recent spans already captures almost
+// all the benefit. Tune it up if a consumer is shown to thrash it.
+const overlapCacheSize = 8
+
+// negInf and posInf stand in for "no predecessor"/"no successor" when
+// certifying a gap. They're comfortably outside any real buffer
+// offset without risking overflow in comparisons against it.
+const (
+	negInf = -1 << 31
+	posInf = 1<<31 - 1
+)
+
+// overlapSpan is a certified answer for every point in [lo, hi]:
+// either the span is known to contain no region (empty), or every
+// point in it is known to fall inside region.
+type overlapSpan struct {
+	lo, hi int
+	region Region
+	empty  bool
+}
+
+func (s overlapSpan) coversPoint(p int) bool {
+	return p >= s.lo && p <= s.hi
+}
+
+// cacheLookup returns the certified span covering p, if any. The cache
+// has its own mutex, separate from r.lock, since it's mutated from
+// ContainsPoint while only an RLock on r.lock is held.
+func (r *RegionSet) cacheLookup(p int) (overlapSpan, bool) {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	for _, s := range r.cache {
+		if s.coversPoint(p) {
+			return s, true
+		}
+	}
+	return overlapSpan{}, false
+}
+
+// cacheCertify remembers s, evicting the oldest entry once the cache
+// is full.
+func (r *RegionSet) cacheCertify(s overlapSpan) {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	if len(r.cache) >= overlapCacheSize {
+		r.cache = r.cache[1:]
+	}
+	r.cache = append(r.cache, s)
+}
+
+// invalidateCache drops every certified span. Called wholesale rather
+// than by intersecting the mutated range, since RegionSet mutations
+// are assumed to be infrequent relative to the point queries the
+// cache serves.
+func (r *RegionSet) invalidateCache() {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	r.cache = r.cache[:0]
+}
+
+// emptyGapAround certifies the maximal span around p that is known to
+// contain no region, given that a query already found none covering p
+// itself. It only looks at p's immediate predecessor and successor in
+// the tree, not the regions beyond them. The caller must hold at
+// least an RLock on r.lock.
+func (r *RegionSet) emptyGapAround(p int) overlapSpan {
+	lo := negInf
+	if pred, ok := r.tree.Predecessor(p); ok {
+		lo = pred.End() + 1
+	}
+	hi := posInf
+	if succ, ok := r.tree.Successor(p); ok {
+		hi = succ.Begin() - 1
+	}
+	return overlapSpan{lo: lo, hi: hi, empty: true}
+}
+
+// ContainsPoint returns whether p falls within any region in the set.
+// Repeated queries into the same neighbourhood are served from a
+// small cache of spans already certified empty or covered, see
+// overlapCacheSize, instead of re-walking the tree every time.
+func (r *RegionSet) ContainsPoint(p int) bool {
+	if s, ok := r.cacheLookup(p); ok {
+		return !s.empty
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, reg := range r.tree.Overlapping(Region{p, p}) {
+		if reg.Contains(p) {
+			r.cacheCertify(overlapSpan{lo: reg.Begin(), hi: reg.End(), region: reg})
+			return true
+		}
+	}
+	r.cacheCertify(r.emptyGapAround(p))
+	return false
+}
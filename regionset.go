@@ -5,6 +5,7 @@
 package text
 
 import (
+	"sort"
 	"sync"
 )
 
@@ -15,158 +16,298 @@ import (
 // are not merged into a single region. This is because
 // otherwise it would not be possible to have multiple
 // cursors right next to each other.
+//
+// Regions are kept in a regionTree rather than a flat slice, so that
+// Add, Contains and AddAll only need to look at the regions that can
+// plausibly overlap instead of scanning the whole set. Subtract still
+// visits every region in the set and rebuilds the tree from them.
 type RegionSet struct {
-	regions           []Region
-	onChangeCallbacks map[string]func()
-	lock              sync.Mutex
+	tree                   regionTree
+	cache                  []overlapSpan
+	cacheMu                sync.Mutex
+	onChangeCallbacks      map[string]*onChangeEntry
+	onChangeEventCallbacks map[string]func(ChangeEvent)
+	lock                   sync.RWMutex
 }
 
-// Adjust adjusts all the regions in the set
-func (r *RegionSet) Adjust(position, delta int) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	for i := range r.regions {
-		r.regions[i].Adjust(position, delta)
+// regionsLocked returns the regions in the set, sorted by Begin(). The
+// caller must hold r.lock.
+func (r *RegionSet) regionsLocked() []Region {
+	ret := make([]Region, 0, r.tree.Len())
+	r.tree.Ascend(func(reg Region) bool {
+		ret = append(ret, reg)
+		return true
+	})
+	return ret
+}
+
+// coverAll folds ov into reference with successive Cover calls,
+// returning the single region that covers reference and all of ov.
+func coverAll(reference Region, ov []Region) Region {
+	for _, o := range ov {
+		reference = reference.Cover(o)
 	}
-	r.flush()
+	return reference
 }
 
-// Returns a list of the indices between start and end of the regions that overlaps
-// with the given reference region.
-func (r *RegionSet) overlaps(reference Region, start, end int) (ret []int) {
-	for i := start; i < end; i++ {
-		if reference == r.regions[i] || reference.Intersects(r.regions[i]) || reference.Covers(r.regions[i]) {
-			ret = append(ret, i)
+// mergeSorted merges overlapping regions in rs, which must already be
+// sorted by Begin(). Since the input is sorted, a region only ever
+// needs to be compared against the region it is currently being
+// merged into, not every region seen so far.
+func mergeSorted(rs []Region) []Region {
+	if len(rs) == 0 {
+		return rs
+	}
+	merged := make([]Region, 0, len(rs))
+	cur := rs[0]
+	for _, next := range rs[1:] {
+		if overlapsRegion(cur, next) {
+			cur = cur.Cover(next)
+		} else {
+			merged = append(merged, cur)
+			cur = next
 		}
 	}
-	return
+	return append(merged, cur)
 }
 
-// Merge all regions in the given "merge"-list with the region at index "reference"
-func (r *RegionSet) merge(reference int, merge []int) {
-	for _, j := range merge {
-		// merge "j" into "reference"
-		r.regions[reference] = r.regions[reference].Cover(r.regions[j])
+// mergeGroup records that from, previously distinct regions, were
+// coalesced into region.
+type mergeGroup struct {
+	region Region
+	from   []Region
+}
+
+// mergeSortedWithEvent is mergeSorted, plus the merge groups it formed
+// along the way, for callers that need to report them in a
+// ChangeEvent.
+func mergeSortedWithEvent(rs []Region) ([]Region, []mergeGroup) {
+	if len(rs) == 0 {
+		return rs, nil
 	}
-	l := len(merge) - 1
-	// keep track of how many indices we have removed thus far
-	adj := 0
-	for i, j1 := range merge {
-		j2 := len(r.regions) - adj
-		if i < l {
-			j2 = merge[i+1] - 1
+	var merged []Region
+	var groups []mergeGroup
+	cur, from := rs[0], []Region{rs[0]}
+	closeGroup := func() {
+		merged = append(merged, cur)
+		if len(from) > 1 {
+			groups = append(groups, mergeGroup{region: cur, from: from})
 		}
-		// remove "j" from the region list by shifting all trailing regions up one step
-		if j2 > 0 && j1+1 <= j2 {
-			copy(r.regions[j1-adj:], r.regions[j1+1:j2])
+	}
+	for _, next := range rs[1:] {
+		if overlapsRegion(cur, next) {
+			cur = cur.Cover(next)
+			from = append(from, next)
+		} else {
+			closeGroup()
+			cur, from = next, []Region{next}
 		}
-		adj++
 	}
-	r.regions = r.regions[:len(r.regions)-len(merge)]
+	closeGroup()
+	return merged, groups
 }
 
-// Before calling flush lock should be locked
-func (r *RegionSet) flush() {
-	for i := 1; i < len(r.regions); i++ {
-		ov := r.overlaps(r.regions[i], 0, i)
-		if len(ov) == 0 {
-			continue
-		}
-		r.merge(ov[0], append(ov[1:], i))
+// Adjust adjusts all the regions in the set
+func (r *RegionSet) Adjust(position, delta int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rs := r.regionsLocked()
+	for i := range rs {
+		rs[i].Adjust(position, delta)
+	}
+	r.tree = buildRegionTree(rs)
+	r.flush(ChangeEvent{})
+}
+
+// Overlapping returns the regions currently in the set that overlap
+// reference, sorted by Begin(). Unlike Contains, it doesn't require
+// reference to be equal to or covered by an existing region.
+func (r *RegionSet) Overlapping(reference Region) []Region {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.tree.Overlapping(reference)
+}
+
+// Before calling flush, lock should be locked. flush re-merges any
+// regions that overlap after a bulk change (Adjust, Clear) may have
+// left overlapping regions in the tree, then notifies listeners with
+// ev plus whatever that re-merge itself added.
+func (r *RegionSet) flush(ev ChangeEvent) {
+	merged, groups := mergeSortedWithEvent(r.regionsLocked())
+	r.tree = buildRegionTree(merged)
+	r.invalidateCache()
+	for _, g := range groups {
+		ev.Added = append(ev.Added, g.region)
+		ev.Removed = append(ev.Removed, g.from...)
+		ev.Merged = append(ev.Merged, g.from)
 	}
 
 	r.lock.Unlock()
 	defer r.lock.Lock()
-	r.onChange()
+	r.notify(ev)
 }
 
 // Subtract removes the given region from the set
 func (r *RegionSet) Subtract(r2 Region) {
-	r3 := r.Cut(r2)
 	r.lock.Lock()
-	r.regions = r3.regions
+	tree, ev := r.cutLocked(r2)
+	r.tree = tree
+	r.invalidateCache()
 	r.lock.Unlock()
 
-	r.onChange()
+	r.notify(ev)
 }
 
 // Add adds the given region to the set
 func (r *RegionSet) Add(r2 Region) {
-	func() {
-		r.lock.Lock()
-		defer r.lock.Unlock()
-		ov := r.overlaps(r2, 0, len(r.regions))
-		r.regions = append(r.regions, r2)
-		if len(ov) == 0 {
-			return
-		}
-		ref := ov[0]
-		ov = append(ov[1:], len(r.regions)-1)
-		r.merge(ref, ov)
-	}()
+	r.lock.Lock()
+	ov := r.tree.Overlapping(r2)
+	merged := r.mergeInsert(r2, ov)
+	r.invalidateCache()
+	r.lock.Unlock()
+
+	r.notify(addEvent(r2, ov, merged))
+}
+
+// mergeInsert removes ov from the tree, inserts the single region
+// that covers r2 and ov, and returns that region. The caller must
+// hold r.lock.
+func (r *RegionSet) mergeInsert(r2 Region, ov []Region) Region {
+	merged := coverAll(r2, ov)
+	for _, o := range ov {
+		r.tree.Remove(o)
+	}
+	r.tree.Insert(merged)
+	return merged
+}
+
+// addLocked merges r2 into the tree, without reporting the merge as a
+// ChangeEvent. Used by AddAll, which reports one combined ChangeEvent
+// for the whole batch rather than one per added region.
+// The caller must hold r.lock.
+func (r *RegionSet) addLocked(r2 Region) {
+	r.mergeInsert(r2, r.tree.Overlapping(r2))
+}
+
+// addEvent builds the ChangeEvent for merging r2 with ov into merged.
+// ov is the only thing that was "removed" by the merge: r2 is new, so
+// it never belonged in Removed or in a Merged entry, only ov does.
+//
+// If r2 fell entirely inside a single existing region, merged is that
+// region unchanged and the event is empty.
+func addEvent(r2 Region, ov []Region, merged Region) ChangeEvent {
+	if len(ov) == 1 && ov[0] == merged {
+		return ChangeEvent{}
+	}
+	ev := ChangeEvent{Added: []Region{merged}}
+	if len(ov) > 0 {
+		ev.Removed = ov
+		ev.Merged = [][]Region{ov}
+	}
+	return ev
+}
+
+// CheckAndAdd adds r2 to the set, but only if check returns nil when
+// given the regions r2 currently overlaps. check runs under the same
+// lock acquisition as the add itself, so callers that would otherwise
+// need a Contains/overlaps check followed by a separate Add no longer
+// race against another goroutine mutating the set in between.
+//
+// check must not call back into r, directly or indirectly (Contains,
+// Len, Regions, Get, Add, ...): r.lock is a non-reentrant sync.RWMutex
+// already held for writing at that point, so any such call deadlocks.
+func (r *RegionSet) CheckAndAdd(r2 Region, check func(existing []Region) error) error {
+	r.lock.Lock()
+	ov := r.tree.Overlapping(r2)
+	if err := check(ov); err != nil {
+		r.lock.Unlock()
+		return err
+	}
+	merged := r.mergeInsert(r2, ov)
+	r.invalidateCache()
+	r.lock.Unlock()
 
-	r.onChange()
+	r.notify(addEvent(r2, ov, merged))
+	return nil
 }
 
 // Clear clears the set
 func (r *RegionSet) Clear() {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	r.regions = r.regions[0:0]
-	r.flush()
+	ev := ChangeEvent{Removed: r.regionsLocked()}
+	r.tree = regionTree{}
+	r.flush(ev)
 }
 
 // Get returns the region at index i
-func (r *RegionSet) Get(i int) Region {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	return r.regions[i]
+func (r *RegionSet) Get(i int) (ret Region) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	idx := 0
+	r.tree.Ascend(func(reg Region) bool {
+		if idx == i {
+			ret = reg
+			return false
+		}
+		idx++
+		return true
+	})
+	return
 }
 
 // Len returns the number of regions contained in the set
 func (r *RegionSet) Len() int {
-	return len(r.regions)
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.tree.Len()
 }
 
 // AddAll adds all regions in the array to the set, merging any overlapping regions into a single region
 func (r *RegionSet) AddAll(rs []Region) {
 	r.lock.Lock()
-	// Merge regions in rs that overlap
-	rr := RegionSet{regions: rs}
-	rr.lock.Lock()
-	rr.flush()
-	rr.lock.Unlock()
-	rs = rr.Regions()
-
-	// r.regions is already by itself maintained
-	// as a non-overlapping RegionSet
-	start := len(r.regions)
-	r.regions = append(r.regions, rs...)
-
-	// In other words, we just need to check overlap between rs
-	// and the previous r.region-set
+	before := r.regionsLocked()
+
+	// Merge regions in rs that overlap among themselves first.
+	rs = mergeSorted(sortRegions(rs))
+
+	// r.tree is already by itself maintained as a non-overlapping set,
+	// so rs only needs to be checked against it, not against itself.
 	for _, r2 := range rs {
-		ov := r.overlaps(r2, 0, start)
-		if len(ov) == 0 {
-			continue
-		}
-		ref := ov[0]
-		ov = append(ov[1:], len(r.regions)-1)
-		r.merge(ref, ov)
-		start -= len(ov)
+		r.addLocked(r2)
 	}
+	r.invalidateCache()
+
+	// Diffed against the final tree rather than summed step by step, so
+	// a region added by one step but folded into a later step's merge
+	// is never reported as Added at all.
+	after := r.regionsLocked()
 	r.lock.Unlock()
 
-	r.onChange()
+	r.notify(diffRegions(before, after))
+}
+
+// sortRegions returns a copy of rs sorted by Begin().
+func sortRegions(rs []Region) []Region {
+	ret := append([]Region(nil), rs...)
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Begin() < ret[j].Begin()
+	})
+	return ret
 }
 
 // Contains returns whether the specified region is part of the set or not
 func (r *RegionSet) Contains(r2 Region) bool {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+	if r2.Begin() == r2.End() {
+		// A point query: served from the overlap cache, see ContainsPoint.
+		return r.ContainsPoint(r2.Begin())
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
 
-	for i := range r.regions {
-		if r.regions[i] == r2 || (r.regions[i].Contains(r2.Begin()) && r.regions[i].Contains(r2.End())) {
+	for _, reg := range r.tree.Overlapping(r2) {
+		if reg == r2 || (reg.Contains(r2.Begin()) && reg.Contains(r2.End())) {
 			return true
 		}
 	}
@@ -174,75 +315,86 @@ func (r *RegionSet) Contains(r2 Region) bool {
 }
 
 // Regions returns a copy of the regions in the set
-func (r *RegionSet) Regions() (ret []Region) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	ret = make([]Region, len(r.regions))
-	copy(ret, r.regions)
-	return
+func (r *RegionSet) Regions() []Region {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.regionsLocked()
 }
 
 // HasNonEmpty returns whether the set contains at least one
 // region that isn't empty.
 func (r *RegionSet) HasNonEmpty() bool {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	for _, r := range r.regions {
-		if !r.Empty() {
-			return true
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	found := false
+	r.tree.Ascend(func(reg Region) bool {
+		if !reg.Empty() {
+			found = true
+			return false
 		}
-	}
-	return false
+		return true
+	})
+	return found
 }
 
 // HasEmpty returns the opposite of #HasNonEmpty
 func (r *RegionSet) HasEmpty() bool {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	for _, r := range r.regions {
-		if r.Empty() {
-			return true
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	found := false
+	r.tree.Ascend(func(reg Region) bool {
+		if reg.Empty() {
+			found = true
+			return false
 		}
-	}
-	return false
+		return true
+	})
+	return found
 }
 
-// Cut cuts away the provided region from the set, and returns
-// the new set
-func (r *RegionSet) Cut(r2 Region) (ret RegionSet) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+// cutLocked returns the tree obtained by cutting r2 out of every
+// region currently in the set, along with a ChangeEvent describing
+// which original regions were touched and what they turned into. The
+// caller must hold at least an RLock on r.lock.
+func (r *RegionSet) cutLocked(r2 Region) (regionTree, ChangeEvent) {
+	var tree regionTree
+	var ev ChangeEvent
 
-	for i := 0; i < len(r.regions); i++ {
-		for _, xor := range r.regions[i].Cut(r2) {
-			if !xor.Empty() {
-				ret.Add(xor)
-			}
+	// put merges reg into tree the same way Add would, and returns the
+	// resulting region.
+	put := func(reg Region) Region {
+		ov := tree.Overlapping(reg)
+		merged := coverAll(reg, ov)
+		for _, o := range ov {
+			tree.Remove(o)
 		}
+		tree.Insert(merged)
+		return merged
 	}
-	return
-}
-
-// Adds a callback func() identified with the given key.
-// If a callback is already defined for that name, it is overwritten
-func (r *RegionSet) AddOnChange(key string, cb func()) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	if r.onChangeCallbacks == nil {
-		r.onChangeCallbacks = make(map[string]func())
-	}
-	r.onChangeCallbacks[key] = cb
-}
 
-// Removes the callback func() associated with the given key.
-func (r *RegionSet) ClearOnChange(key string) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	delete(r.onChangeCallbacks, key)
+	r.tree.Ascend(func(reg Region) bool {
+		pieces := reg.Cut(r2)
+		if len(pieces) == 1 && pieces[0] == reg {
+			// r2 didn't touch reg: carry it over unchanged.
+			put(reg)
+			return true
+		}
+		ev.Removed = append(ev.Removed, reg)
+		for _, xor := range pieces {
+			if !xor.Empty() {
+				ev.Added = append(ev.Added, put(xor))
+			}
+		}
+		return true
+	})
+	return tree, ev
 }
 
-func (r *RegionSet) onChange() {
-	for _, cb := range r.onChangeCallbacks {
-		cb()
-	}
+// Cut cuts away the provided region from the set, and returns
+// the new set
+func (r *RegionSet) Cut(r2 Region) (ret RegionSet) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret.tree, _ = r.cutLocked(r2)
+	return
 }
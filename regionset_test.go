@@ -0,0 +1,184 @@
+// Copyright 2013 Fredrik Ehnbom
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package text
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestAddMergeEvent exercises the exact scenario the ChangeEvent
+// invariant covers: Add-ing a region that bridges two existing ones
+// must report the union as Added, the two originals as Removed, and
+// must not leak the newly-added region itself into Merged.
+func TestAddMergeEvent(t *testing.T) {
+	var rs RegionSet
+	rs.Add(Region{0, 5})
+	rs.Add(Region{10, 15})
+
+	var got ChangeEvent
+	rs.AddOnChangeEvent("t", func(ev ChangeEvent) { got = ev })
+	rs.Add(Region{4, 11})
+
+	regionsEqual(t, got.Added, []Region{{0, 15}})
+	regionsEqual(t, got.Removed, []Region{{0, 5}, {10, 15}})
+	if len(got.Merged) != 1 {
+		t.Fatalf("Merged = %v, want one group", got.Merged)
+	}
+	regionsEqual(t, got.Merged[0], []Region{{0, 5}, {10, 15}})
+	for _, from := range got.Merged {
+		for _, f := range from {
+			found := false
+			for _, rm := range got.Removed {
+				if rm == f {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("Merged region %v not present in Removed %v", f, got.Removed)
+			}
+		}
+	}
+}
+
+// TestAddAllChainedMerge checks that AddAll reports the final outcome
+// of a batch, not a sum of each step's intermediate merges: three
+// disjoint regions that only connect up to each other once the whole
+// batch lands must be reported as a single Added region, and nothing
+// from the batch should ever show up in both Added and Removed.
+func TestAddAllChainedMerge(t *testing.T) {
+	var rs RegionSet
+	rs.Add(Region{0, 2})
+	rs.Add(Region{9, 11})
+
+	var got ChangeEvent
+	rs.AddOnChangeEvent("t", func(ev ChangeEvent) { got = ev })
+	// {1,10} bridges {0,2} and {9,11} into one region in a single
+	// batch; {1,10} itself is brand new within the batch and must never
+	// appear in Added (it's immediately absorbed) nor Removed.
+	rs.AddAll([]Region{{1, 10}})
+
+	regionsEqual(t, got.Added, []Region{{0, 11}})
+	regionsEqual(t, got.Removed, []Region{{0, 2}, {9, 11}})
+	for _, a := range got.Added {
+		for _, rm := range got.Removed {
+			if a == rm {
+				t.Fatalf("region %v reported as both Added and Removed", a)
+			}
+		}
+	}
+}
+
+// TestCheckAndAddRejects confirms check can veto an Add without it
+// taking effect.
+func TestCheckAndAddRejects(t *testing.T) {
+	var rs RegionSet
+	rs.Add(Region{0, 5})
+
+	err := rs.CheckAndAdd(Region{3, 8}, func(existing []Region) error {
+		if len(existing) > 0 {
+			return errBusy
+		}
+		return nil
+	})
+	if err != errBusy {
+		t.Fatalf("err = %v, want errBusy", err)
+	}
+	regionsEqual(t, rs.Regions(), []Region{{0, 5}})
+}
+
+var errBusy = errors.New("busy")
+
+// TestConcurrentAddContainsPoint exercises Add running concurrently
+// with ContainsPoint, the path the overlap cache and the RWMutex both
+// guard; run with -race to catch lock or cache misuse.
+func TestConcurrentAddContainsPoint(t *testing.T) {
+	var rs RegionSet
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			rs.Add(Region{i * 10, i*10 + 5})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			rs.ContainsPoint(i * 10)
+		}
+	}()
+	wg.Wait()
+}
+
+// TestAsyncBackpressure checks that a slow Async callback on one key
+// doesn't stall fires for another key.
+func TestAsyncBackpressure(t *testing.T) {
+	var rs RegionSet
+
+	block := make(chan struct{})
+	slowDone := make(chan struct{})
+	rs.AddOnChangeMode("slow", Async, func() {
+		<-block
+		close(slowDone)
+	})
+
+	fastDone := make(chan struct{}, 10)
+	rs.AddOnChangeMode("fast", Async, func() {
+		fastDone <- struct{}{}
+	})
+
+	rs.Add(Region{0, 1})
+
+	select {
+	case <-fastDone:
+	case <-time.After(time.Second):
+		t.Fatal("fast callback never ran; slow callback appears to have blocked it")
+	}
+
+	close(block)
+	select {
+	case <-slowDone:
+	case <-time.After(time.Second):
+		t.Fatal("slow callback never completed")
+	}
+}
+
+// TestAsyncClearConcurrentWithMutation exercises ClearOnChange and
+// re-registering an Async key concurrently with mutations that fire
+// it. It must not panic: a previous version closed the entry's
+// channel on ClearOnChange/overwrite, which could race a send already
+// in flight from onChange's RLock-released snapshot.
+func TestAsyncClearConcurrentWithMutation(t *testing.T) {
+	var rs RegionSet
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	stop := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			rs.Add(Region{i, i + 1})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			rs.ClearOnChange("k")
+			rs.AddOnChangeMode("k", Async, func() {})
+		}
+		close(stop)
+	}()
+	wg.Wait()
+}
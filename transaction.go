@@ -0,0 +1,148 @@
+// Copyright 2013 Fredrik Ehnbom
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package text
+
+// txOpKind identifies which mutation a txOp buffers.
+type txOpKind int
+
+const (
+	txAdd txOpKind = iota
+	txSubtract
+	txClear
+)
+
+// txOp is a single buffered mutation in a Transaction.
+type txOp struct {
+	kind   txOpKind
+	region Region
+}
+
+// Transaction buffers a sequence of Add, Subtract and Clear calls
+// against a RegionSet and applies them all under a single lock
+// acquisition, firing onChange once after the last of them instead of
+// once per call. Use it for composite mutations that would otherwise
+// need to be built from the individual methods under separate lock
+// acquisitions, racing against any other goroutine mutating the set
+// in between.
+//
+// A Transaction is not safe to share across goroutines; build up one
+// per composite mutation and Commit it.
+type Transaction struct {
+	set *RegionSet
+	ops []txOp
+}
+
+// Begin returns a Transaction that buffers mutations against r until
+// Commit is called.
+func (r *RegionSet) Begin() *Transaction {
+	return &Transaction{set: r}
+}
+
+// Add buffers adding region to the set.
+func (t *Transaction) Add(region Region) *Transaction {
+	t.ops = append(t.ops, txOp{kind: txAdd, region: region})
+	return t
+}
+
+// Subtract buffers removing region from the set.
+func (t *Transaction) Subtract(region Region) *Transaction {
+	t.ops = append(t.ops, txOp{kind: txSubtract, region: region})
+	return t
+}
+
+// Clear buffers clearing the set.
+func (t *Transaction) Clear() *Transaction {
+	t.ops = append(t.ops, txOp{kind: txClear})
+	return t
+}
+
+// Commit applies every buffered operation under a single lock
+// acquisition and, if any operation was buffered, notifies listeners
+// once with a ChangeEvent describing the combined effect of the whole
+// batch.
+//
+// The event is built by tracking provenance as each op is applied,
+// the same way addEvent/cutLocked do for a single op, rather than by
+// diffing the set before and after the whole batch: a before/after
+// diff can't tell "this pre-transaction region was folded into that
+// Added region by a merge" apart from "this pre-transaction region was
+// deleted by an unrelated Subtract or Clear and happens to fall inside
+// some other Added region's span" — see diffRegions, whose use by
+// AddAll is safe only because AddAll never deletes anything.
+func (t *Transaction) Commit() {
+	if len(t.ops) == 0 {
+		return
+	}
+
+	r := t.set
+	r.lock.Lock()
+
+	// provenance maps a currently-live region, built up during this
+	// transaction, to the pre-transaction regions it was ultimately
+	// folded from. A present key with a nil/empty value is a region
+	// that's new this transaction but never merged with anything; an
+	// absent key is a pre-transaction region this transaction hasn't
+	// touched at all.
+	provenance := map[Region][]Region{}
+	var trulyRemoved []Region
+
+	resolve := func(reg Region) []Region {
+		if from, ok := provenance[reg]; ok {
+			delete(provenance, reg)
+			return from
+		}
+		return []Region{reg}
+	}
+
+	for _, op := range t.ops {
+		switch op.kind {
+		case txAdd:
+			ov := r.tree.Overlapping(op.region)
+			merged := r.mergeInsert(op.region, ov)
+			var from []Region
+			for _, o := range ov {
+				from = append(from, resolve(o)...)
+			}
+			provenance[merged] = from
+		case txSubtract:
+			tree, ev := r.cutLocked(op.region)
+			r.tree = tree
+			for _, gone := range ev.Removed {
+				trulyRemoved = append(trulyRemoved, resolve(gone)...)
+			}
+			for _, frag := range ev.Added {
+				provenance[frag] = nil
+			}
+		case txClear:
+			r.tree.Ascend(func(reg Region) bool {
+				trulyRemoved = append(trulyRemoved, resolve(reg)...)
+				return true
+			})
+			r.tree = regionTree{}
+		}
+	}
+	r.invalidateCache()
+
+	var ev ChangeEvent
+	r.tree.Ascend(func(reg Region) bool {
+		from, ok := provenance[reg]
+		if !ok {
+			return true // untouched by this transaction
+		}
+		if len(from) == 1 && from[0] == reg {
+			return true // only absorbed Adds that fell inside it
+		}
+		ev.Added = append(ev.Added, reg)
+		if len(from) > 0 {
+			ev.Removed = append(ev.Removed, from...)
+			ev.Merged = append(ev.Merged, from)
+		}
+		return true
+	})
+	ev.Removed = append(ev.Removed, trulyRemoved...)
+	r.lock.Unlock()
+
+	r.notify(ev)
+}
@@ -0,0 +1,74 @@
+// Copyright 2013 Fredrik Ehnbom
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package text
+
+import "testing"
+
+// TestTransactionMixedSubtractAddDoesNotFakeMerge is the exact repro
+// from review: a Subtract that deletes a region outright must not be
+// reported as having been coalesced into an unrelated Added region
+// from a later Add in the same transaction, just because it
+// geometrically falls inside that Added region's span.
+func TestTransactionMixedSubtractAddDoesNotFakeMerge(t *testing.T) {
+	var rs RegionSet
+	rs.Add(Region{0, 3})
+	rs.Add(Region{5, 8})
+
+	var got ChangeEvent
+	rs.AddOnChangeEvent("t", func(ev ChangeEvent) { got = ev })
+
+	rs.Begin().Subtract(Region{5, 8}).Add(Region{0, 8}).Commit()
+
+	regionsEqual(t, got.Added, []Region{{0, 8}})
+	regionsEqual(t, got.Removed, []Region{{0, 3}, {5, 8}})
+	if len(got.Merged) != 1 {
+		t.Fatalf("Merged = %v, want exactly one group", got.Merged)
+	}
+	regionsEqual(t, got.Merged[0], []Region{{0, 3}})
+}
+
+// TestTransactionAddThenFurtherMerge checks that a region merged by
+// one buffered Add and then folded into an even larger region by a
+// later buffered Add in the same transaction is reported only as its
+// final shape, tracing Merged back to the real pre-transaction
+// regions rather than the transient intermediate.
+func TestTransactionAddThenFurtherMerge(t *testing.T) {
+	var rs RegionSet
+	rs.Add(Region{0, 1})
+	rs.Add(Region{10, 11})
+
+	var got ChangeEvent
+	rs.AddOnChangeEvent("t", func(ev ChangeEvent) { got = ev })
+
+	rs.Begin().Add(Region{0, 5}).Add(Region{4, 11}).Commit()
+
+	regionsEqual(t, got.Added, []Region{{0, 11}})
+	regionsEqual(t, got.Removed, []Region{{0, 1}, {10, 11}})
+	if len(got.Merged) != 1 {
+		t.Fatalf("Merged = %v, want exactly one group", got.Merged)
+	}
+	regionsEqual(t, got.Merged[0], []Region{{0, 1}, {10, 11}})
+}
+
+// TestTransactionClearReportsOriginals checks that Clear inside a
+// Transaction reports the pre-transaction regions as Removed, not any
+// transient region built up earlier in the same transaction.
+func TestTransactionClearReportsOriginals(t *testing.T) {
+	var rs RegionSet
+	rs.Add(Region{0, 1})
+
+	var got ChangeEvent
+	rs.AddOnChangeEvent("t", func(ev ChangeEvent) { got = ev })
+
+	rs.Begin().Add(Region{2, 3}).Clear().Commit()
+
+	if len(got.Added) != 0 {
+		t.Fatalf("Added = %v, want none", got.Added)
+	}
+	regionsEqual(t, got.Removed, []Region{{0, 1}})
+	if len(rs.Regions()) != 0 {
+		t.Fatalf("Regions() = %v, want empty after Clear", rs.Regions())
+	}
+}